@@ -2,10 +2,15 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/clayzim/http-servers/internal/auth"
@@ -13,6 +18,55 @@ import (
 	"github.com/google/uuid"
 )
 
+// Access tokens are intentionally short-lived; refresh tokens
+// carry the long-lived session and can be individually revoked
+const accessTokenExpiry = 15 * time.Minute
+const refreshTokenExpiry = 60 * 24 * time.Hour
+
+// Page size for GET /api/chirps when the caller doesn't specify ?limit
+const defaultChirpPageLimit = 20
+
+// Opaque keyset cursor: the (created_at, id) of the last chirp
+// seen, so the next page can resume exactly where it left off
+type chirpCursor struct {
+	CreatedAt time.Time
+	ID uuid.UUID
+}
+
+// Zero value of chirpCursor encodes to the "first page" cursor
+var firstChirpPage = chirpCursor{}
+
+func encodeChirpCursor(c chirpCursor) string {
+	raw := c.CreatedAt.Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeChirpCursor(encoded string) (chirpCursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return chirpCursor{}, errors.New("malformed cursor")
+	}
+	createdAtPart, idPart, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return chirpCursor{}, errors.New("malformed cursor")
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, createdAtPart)
+	if err != nil {
+		return chirpCursor{}, errors.New("malformed cursor")
+	}
+	id, err := uuid.Parse(idPart)
+	if err != nil {
+		return chirpCursor{}, errors.New("malformed cursor")
+	}
+	return chirpCursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// Response body for GET /api/chirps
+type chirpsPageResponse struct {
+	Chirps []Chirp `json:"chirps"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
 // Readiness endpoint
 // Route: /healthz
 // Method: any
@@ -84,10 +138,16 @@ func (cfg *serverState) reset(w http.ResponseWriter, r *http.Request) {
 // Valid parameters for a /chirps request
 type chirpParameters struct {
 	Body string `json:"body"`
-	UserID uuid.UUID `json:"user_id"`
 }
 
 func (cfg *serverState) createChirp(w http.ResponseWriter, r *http.Request) {
+	// Set by mwRequireAuth from the caller's access token;
+	// the request body is no longer trusted for this
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Missing authenticated user")
+		return
+	}
 	// Read JSON Chirp body
 	params := chirpParameters{}
 	err := readJSONBody(r, &params)
@@ -98,9 +158,6 @@ func (cfg *serverState) createChirp(w http.ResponseWriter, r *http.Request) {
 			"Failed to parse Chirp")
 		return
 	}
-	// Nonexistant user_ids are disallowed by database schema
-	// TODO: Add validation that the requester is authorized
-	// to chirp on this user's behalf
 	body := params.Body
 
 	len := utf8.RuneCountInString(body)
@@ -119,7 +176,7 @@ func (cfg *serverState) createChirp(w http.ResponseWriter, r *http.Request) {
 	body = censorProfanity(body)
 	p := database.CreateChirpParams{
 		Body: body,
-		UserID: params.UserID,
+		UserID: userID,
 	}
 	chirp, err := cfg.db.CreateChirp(r.Context(), p)
 	if err != nil {
@@ -133,23 +190,86 @@ func (cfg *serverState) createChirp(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *serverState) getAllChirps(w http.ResponseWriter, r *http.Request) {
-	// No request body needed
-	// Execute the database query
-	dbChirps, err := cfg.db.GetAllChirps(r.Context())
-	if err != nil {
+	q := r.URL.Query()
+
+	// Default to newest-first unless the caller asks otherwise
+	sortAsc := q.Get("sort") == "asc"
+
+	limit := defaultChirpPageLimit
+	if limitParam := q.Get("limit"); limitParam != "" {
+		parsed, err := strconv.Atoi(limitParam)
+		if err != nil || parsed <= 0 {
+			respondWithError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = parsed
+	}
+	if limit > cfg.maxChirpPageLimit {
 		respondWithError(
 			w,
-			http.StatusInternalServerError,
-			"Failed to retrieve all chirps")
+			http.StatusBadRequest,
+			fmt.Sprintf("limit cannot exceed %d", cfg.maxChirpPageLimit),
+		)
+		return
+	}
+
+	cursor := firstChirpPage
+	if cursorParam := q.Get("cursor"); cursorParam != "" {
+		parsed, err := decodeChirpCursor(cursorParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		cursor = parsed
+	}
+
+	var authorID uuid.NullUUID
+	if authorParam := q.Get("author_id"); authorParam != "" {
+		parsed, err := uuid.Parse(authorParam)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid author_id")
+			return
+		}
+		authorID = uuid.NullUUID{UUID: parsed, Valid: true}
+	}
+
+	// Fetch one row past the page so we know whether to emit a next_cursor
+	var dbChirps []database.Chirp
+	var err error
+	if authorID.Valid {
+		dbChirps, err = cfg.db.GetChirpsByAuthorPage(r.Context(), database.GetChirpsByAuthorPageParams{
+			UserID: authorID.UUID,
+			SortAsc: sortAsc,
+			CursorCreatedAt: cursor.CreatedAt,
+			CursorID: cursor.ID,
+			PageLimit: int32(limit + 1),
+		})
+	} else {
+		dbChirps, err = cfg.db.GetChirpsPage(r.Context(), database.GetChirpsPageParams{
+			SortAsc: sortAsc,
+			CursorCreatedAt: cursor.CreatedAt,
+			CursorID: cursor.ID,
+			PageLimit: int32(limit + 1),
+		})
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve chirps")
 		return
 	}
-	// Wrap all chirps in JSON-annotated model
-	var chirps []Chirp
+
+	hasNextPage := len(dbChirps) > limit
+	if hasNextPage {
+		dbChirps = dbChirps[:limit]
+	}
+	resp := chirpsPageResponse{Chirps: make([]Chirp, 0, len(dbChirps))}
 	for _, dbChirp := range dbChirps {
-		chirps = append(chirps, Chirp(dbChirp))
+		resp.Chirps = append(resp.Chirps, Chirp(dbChirp))
 	}
-	// Write a JSON response with a list of all chirps
-	respondWithJSON(w, http.StatusOK, chirps)
+	if hasNextPage {
+		last := resp.Chirps[len(resp.Chirps)-1]
+		resp.NextCursor = encodeChirpCursor(chirpCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+	respondWithJSON(w, http.StatusOK, resp)
 }
 
 func (cfg *serverState) getChirp(w http.ResponseWriter, r *http.Request) {
@@ -201,6 +321,241 @@ func (cfg *serverState) getChirp(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, Chirp(dbChirp))
 }
 
+func (cfg *serverState) deleteChirp(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Missing authenticated user")
+		return
+	}
+	idString := r.PathValue("chirpID")
+	if err := uuid.Validate(idString); err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	chirpID, err := uuid.Parse(idString)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to parse chirp ID")
+		return
+	}
+	dbChirp, err := cfg.db.GetChirpByID(r.Context(), chirpID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(
+				w,
+				http.StatusNotFound,
+				fmt.Sprintf("No chirp exists with ID %s", chirpID.String()),
+			)
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve chirp by ID")
+		}
+		return
+	}
+	// Author may always delete their own chirp; anyone else
+	// needs the admin role
+	if dbChirp.UserID != userID {
+		dbUser, err := cfg.db.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if dbUser.Role != RoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the chirp's author or an admin may delete it")
+			return
+		}
+	}
+	if err := cfg.db.DeleteChirp(r.Context(), chirpID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete chirp")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Valid parameters for an admin promote request
+type promoteUserParameters struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+func (cfg *serverState) promoteUser(w http.ResponseWriter, r *http.Request) {
+	params := promoteUserParameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to parse request")
+		return
+	}
+	dbUser, err := cfg.db.PromoteUser(r.Context(), params.UserID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(w, http.StatusNotFound, "No user exists with that ID")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to promote user")
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ResponseFrom(dbUser))
+}
+
+// Valid parameters for a POST /api/chirps/{chirpID}/comments request
+type commentParameters struct {
+	Body string `json:"body"`
+	// Present when this comment is a reply to another comment
+	ParentCommentID *uuid.UUID `json:"parent_comment_id,omitempty"`
+}
+
+func (cfg *serverState) createComment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Missing authenticated user")
+		return
+	}
+	chirpID, err := parsePathUUID(r, "chirpID")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	if _, err := cfg.db.GetChirpByID(r.Context(), chirpID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(
+				w,
+				http.StatusNotFound,
+				fmt.Sprintf("No chirp exists with ID %s", chirpID.String()),
+			)
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve chirp by ID")
+		}
+		return
+	}
+
+	params := commentParameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to parse comment")
+		return
+	}
+	body := params.Body
+
+	len := utf8.RuneCountInString(body)
+	if len <= 0 {
+		respondWithError(w, http.StatusBadRequest, "Comment cannot be empty")
+		return
+	}
+	if len > maxChirpLength {
+		respondWithError(w, http.StatusBadRequest, "Comment is too long")
+		return
+	}
+	body = censorProfanity(body)
+
+	var parentID uuid.NullUUID
+	if params.ParentCommentID != nil {
+		parent, err := cfg.db.GetCommentByID(r.Context(), *params.ParentCommentID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				respondWithError(w, http.StatusBadRequest, "Parent comment does not exist")
+			} else {
+				respondWithError(w, http.StatusInternalServerError, "Failed to retrieve parent comment")
+			}
+			return
+		}
+		if parent.ChirpID != chirpID {
+			respondWithError(w, http.StatusBadRequest, "Parent comment does not belong to this chirp")
+			return
+		}
+		parentID = uuid.NullUUID{UUID: *params.ParentCommentID, Valid: true}
+	}
+	dbComment, err := cfg.db.CreateComment(r.Context(), database.CreateCommentParams{
+		Body: body,
+		ChirpID: chirpID,
+		UserID: userID,
+		ParentCommentID: parentID,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create comment")
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, CommentFrom(dbComment))
+}
+
+func (cfg *serverState) getCommentsForChirp(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := parsePathUUID(r, "chirpID")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid chirp ID")
+		return
+	}
+	dbComments, err := cfg.db.GetCommentsForChirp(r.Context(), chirpID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve comments")
+		return
+	}
+	comments := make([]Comment, 0, len(dbComments))
+	for _, dbComment := range dbComments {
+		comments = append(comments, CommentFrom(dbComment))
+	}
+	respondWithJSON(w, http.StatusOK, comments)
+}
+
+func (cfg *serverState) getComment(w http.ResponseWriter, r *http.Request) {
+	commentID, err := parsePathUUID(r, "commentID")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid comment ID")
+		return
+	}
+	dbComment, err := cfg.db.GetCommentByID(r.Context(), commentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(
+				w,
+				http.StatusNotFound,
+				fmt.Sprintf("No comment exists with ID %s", commentID.String()),
+			)
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve comment by ID")
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, CommentFrom(dbComment))
+}
+
+func (cfg *serverState) deleteComment(w http.ResponseWriter, r *http.Request) {
+	userID, ok := auth.UserIDFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Missing authenticated user")
+		return
+	}
+	commentID, err := parsePathUUID(r, "commentID")
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid comment ID")
+		return
+	}
+	dbComment, err := cfg.db.GetCommentByID(r.Context(), commentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithError(
+				w,
+				http.StatusNotFound,
+				fmt.Sprintf("No comment exists with ID %s", commentID.String()),
+			)
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to retrieve comment by ID")
+		}
+		return
+	}
+	// Author may always delete their own comment; anyone else
+	// needs the admin role
+	if dbComment.UserID != userID {
+		dbUser, err := cfg.db.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if dbUser.Role != RoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Only the comment's author or an admin may delete it")
+			return
+		}
+	}
+	if err := cfg.db.DeleteComment(r.Context(), commentID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete comment")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // Valid parameters for a /users POST request
 type userParameters struct {
 	Email string `json:"email"`
@@ -253,12 +608,82 @@ func (cfg *serverState) createUser(w http.ResponseWriter, r *http.Request) {
 			"Failed to create user")
 		return
 	}
+
+	// Bootstraps the very first admin: PromoteUser is itself
+	// admin-only, so without this there'd be no way to mint an
+	// admin account short of a direct database edit
+	if cfg.adminBootstrapEmail != "" && strings.EqualFold(dbUser.Email, cfg.adminBootstrapEmail) {
+		if promoted, err := cfg.db.PromoteUser(r.Context(), dbUser.ID); err != nil {
+			log.Printf("failed to bootstrap admin for %s: %s\n", dbUser.Email, err)
+		} else {
+			dbUser = promoted
+		}
+	}
+
+	// A failed send is logged and doesn't fail account creation.
+	// No endpoint re-sends a verification token, so such an
+	// account stays unverified
+	if err := cfg.sendVerificationEmail(r, dbUser); err != nil {
+		log.Printf("failed to send verification email to %s: %s\n", dbUser.Email, err)
+	}
+
 	respondWithJSON(
 		w,
 		http.StatusCreated,
 		ResponseFrom(dbUser))
 }
 
+// Verification tokens outlive a single login session but not by much
+const verificationTokenExpiry = 24 * time.Hour
+
+func (cfg *serverState) sendVerificationEmail(r *http.Request, dbUser database.User) error {
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.CreateVerificationToken(r.Context(), database.CreateVerificationTokenParams{
+		TokenHash: auth.HashToken(token),
+		UserID: dbUser.ID,
+		ExpiresAt: time.Now().UTC().Add(verificationTokenExpiry),
+	})
+	if err != nil {
+		return err
+	}
+	return cfg.mailer.SendVerificationEmail(dbUser.Email, token)
+}
+
+// Valid parameters for a /verify POST request
+type verifyParameters struct {
+	Token string `json:"token"`
+}
+
+func (cfg *serverState) verify(w http.ResponseWriter, r *http.Request) {
+	params := verifyParameters{}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to parse request")
+		return
+	}
+	if params.Token == "" {
+		respondWithError(w, http.StatusBadRequest, "Missing verification token")
+		return
+	}
+
+	// Consumes the token and verifies the account in a single
+	// statement, so a crash between the two can't burn the token
+	// without ever verifying the user
+	tokenHash := auth.HashToken(params.Token)
+	dbUser, err := cfg.db.ConsumeVerificationToken(r.Context(), tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			respondWithMisdirectedError(w, http.StatusBadRequest, "Invalid or expired verification token")
+		} else {
+			respondWithError(w, http.StatusInternalServerError, "Failed to verify email")
+		}
+		return
+	}
+	respondWithJSON(w, http.StatusOK, ResponseFrom(dbUser))
+}
+
 func (cfg *serverState) login(w http.ResponseWriter, r *http.Request) {
 	// Read user email & password from request body
 	params := userParameters{}
@@ -309,8 +734,112 @@ func (cfg *serverState) login(w http.ResponseWriter, r *http.Request) {
 			"Incorrect email or password")
 		return
 	}
-	respondWithJSON(
-		w,
-		http.StatusOK,
-		ResponseFrom(dbUser))
+
+	// Transparently upgrade the stored hash if it was created
+	// with weaker-than-current Argon2id parameters
+	if needsRehash, err := auth.NeedsRehash(hash, auth.CurrentParams()); err == nil && needsRehash {
+		if newHash, err := auth.HashPassword(password); err == nil {
+			if err := cfg.db.UpdateUserPassword(r.Context(), database.UpdateUserPasswordParams{
+				HashedPassword: newHash,
+				ID: dbUser.ID,
+			}); err != nil {
+				log.Printf("failed to rehash password for user %s: %s\n", dbUser.ID, err)
+			}
+		}
+	}
+
+	// Only gate on verification once the password is confirmed
+	// correct, so this check can't be used to probe for which
+	// emails exist
+	if !dbUser.EmailVerifiedAt.Valid {
+		respondWithError(w, http.StatusForbidden, "Email not verified")
+		return
+	}
+
+	accessToken, err := auth.MakeJWT(dbUser.ID, cfg.tokenSecret, accessTokenExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create access token")
+		return
+	}
+	refreshToken, err := cfg.issueRefreshToken(r, dbUser.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create refresh token")
+		return
+	}
+
+	user := ResponseFrom(dbUser)
+	user.Token = accessToken
+	user.RefreshToken = refreshToken
+	respondWithJSON(w, http.StatusOK, user)
+}
+
+// Generates a refresh token and persists its hash, returning the
+// raw token for the caller to hand back on /api/refresh
+func (cfg *serverState) issueRefreshToken(r *http.Request, userID uuid.UUID) (string, error) {
+	refreshToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = cfg.db.CreateRefreshToken(r.Context(), database.CreateRefreshTokenParams{
+		TokenHash: auth.HashToken(refreshToken),
+		UserID:    userID,
+		ExpiresAt: time.Now().UTC().Add(refreshTokenExpiry),
+	})
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func (cfg *serverState) refresh(w http.ResponseWriter, r *http.Request) {
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithMisdirectedError(w, http.StatusUnauthorized, "Malformed or missing refresh token")
+		return
+	}
+	dbToken, err := cfg.db.GetRefreshToken(r.Context(), auth.HashToken(refreshToken))
+	if err != nil {
+		respondWithMisdirectedError(w, http.StatusUnauthorized, "Invalid refresh token")
+		return
+	}
+	if dbToken.RevokedAt.Valid || dbToken.ExpiresAt.Before(time.Now().UTC()) {
+		respondWithMisdirectedError(w, http.StatusUnauthorized, "Refresh token is expired or revoked")
+		return
+	}
+
+	// Single-use: revoke the presented token before minting the
+	// next one, whether or not the rest of this request succeeds
+	if err := cfg.db.RevokeRefreshToken(r.Context(), dbToken.TokenHash); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke refresh token")
+		return
+	}
+
+	accessToken, err := auth.MakeJWT(dbToken.UserID, cfg.tokenSecret, accessTokenExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create access token")
+		return
+	}
+	newRefreshToken, err := cfg.issueRefreshToken(r, dbToken.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to create refresh token")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokenPairResponse{
+		Token:        accessToken,
+		RefreshToken: newRefreshToken,
+	})
+}
+
+func (cfg *serverState) revoke(w http.ResponseWriter, r *http.Request) {
+	refreshToken, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithMisdirectedError(w, http.StatusUnauthorized, "Malformed or missing refresh token")
+		return
+	}
+	if err := cfg.db.RevokeRefreshToken(r.Context(), auth.HashToken(refreshToken)); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke refresh token")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
\ No newline at end of file
@@ -1,45 +1,138 @@
 package auth
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/alexedwards/argon2id"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
-// Constant parameters configured according to the
-// second Argon2id settings from OWASP Cheat Sheet
+// Argon2id cost parameters. Each hash embeds the parameters it was
+// created with (in its PHC string), so changing these only affects
+// passwords hashed (or rehashed) after the change
+type Params struct {
+	// Memory used, in kibibytes
+	Memory uint32
+	Iterations uint32
+	// The number of threads (or lanes) used by the algorithm.
+	// Recommended value is between 1 and runtime.NumCPU()
+	Parallelism uint8
+	// Length of the random salt in bytes
+	SaltLength uint32
+	// Length of the generated hash in bytes
+	KeyLength uint32
+}
+
+// Defaults configured according to the second Argon2id settings
+// from OWASP Cheat Sheet
 // https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#argon2id
 // as of August 30, 2025
+var DefaultParams = Params{
+	Memory: 19 * 1024,
+	Iterations: 2,
+	Parallelism: 1,
+	SaltLength: 16,
+	KeyLength: 32,
+}
 
-// Memory used (in kibibytes)
-const memory uint32 = 19 * 1024
-
-// Number of iterations
-const iterations uint32 = 2
+// Parameters new hashes are created with. Set via SetParams
+// (typically from ParamsFromEnv) before serving any requests
+var currentParams = DefaultParams
 
-// The number of threads (or lanes) used by the algorithm.
-// Recommended value is between 1 and runtime.NumCPU().
-const parallelism uint8 = 1
+func SetParams(p Params) {
+	currentParams = p
+}
 
-// Length of the random salt in bytes
-const saltLength uint32 = 16
+func CurrentParams() Params {
+	return currentParams
+}
 
-// Length of the generated hash in bytes
-const hashLength uint32 = 32
+// Reads ARGON2_MEMORY_KIB, ARGON2_ITERATIONS, ARGON2_PARALLELISM,
+// ARGON2_SALT_LEN and ARGON2_KEY_LEN, falling back to DefaultParams
+// for any that are unset or invalid
+func ParamsFromEnv() Params {
+	p := DefaultParams
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_MEMORY_KIB"), 10, 32); err == nil {
+		p.Memory = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_ITERATIONS"), 10, 32); err == nil {
+		p.Iterations = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_PARALLELISM"), 10, 8); err == nil {
+		p.Parallelism = uint8(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_SALT_LEN"), 10, 32); err == nil {
+		p.SaltLength = uint32(v)
+	}
+	if v, err := strconv.ParseUint(os.Getenv("ARGON2_KEY_LEN"), 10, 32); err == nil {
+		p.KeyLength = uint32(v)
+	}
+	return p
+}
 
 func HashPassword(password string) (string, error) {
 	params := argon2id.Params {
-		Memory: memory,
-		Iterations: iterations,
-		Parallelism: parallelism,
-		SaltLength: saltLength,
-		KeyLength: hashLength,
+		Memory: currentParams.Memory,
+		Iterations: currentParams.Iterations,
+		Parallelism: currentParams.Parallelism,
+		SaltLength: currentParams.SaltLength,
+		KeyLength: currentParams.KeyLength,
 	}
 	return argon2id.CreateHash(password, &params)
 }
 
+// Reports whether hash was created with weaker parameters than
+// current, meaning it should be replaced next time the plaintext
+// password is available (i.e. on successful login)
+func NeedsRehash(hash string, current Params) (bool, error) {
+	params, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return false, err
+	}
+	weaker := params.Memory < current.Memory ||
+		params.Iterations < current.Iterations ||
+		params.Parallelism < current.Parallelism ||
+		params.SaltLength < current.SaltLength ||
+		params.KeyLength < current.KeyLength
+	return weaker, nil
+}
+
+// Increases Memory, holding the other parameters at their default,
+// until a single hash takes at least targetDuration on this host.
+// Intended to be run once, offline, when tuning cost for new hardware
+func Calibrate(targetDuration time.Duration) Params {
+	p := DefaultParams
+	for {
+		params := argon2id.Params{
+			Memory: p.Memory,
+			Iterations: p.Iterations,
+			Parallelism: p.Parallelism,
+			SaltLength: p.SaltLength,
+			KeyLength: p.KeyLength,
+		}
+		start := time.Now()
+		if _, err := argon2id.CreateHash("benchmark-password", &params); err != nil {
+			return p
+		}
+		if time.Since(start) >= targetDuration {
+			return p
+		}
+		p.Memory *= 2
+	}
+}
+
 var ErrMismatchedHashAndPassword = errors.New("internal/auth: Given hash is not the hash of the given password")
 
 func CheckPassword(password, hash string) error {
@@ -68,4 +161,100 @@ func Initialize() {
 	if err != nil {
 		log.Fatal("Failed to initialize auth package")
 	}
+}
+
+// Issuer embedded in every access token so a token minted
+// by another service can't be mistaken for one of ours
+const tokenIssuer = "chirpy"
+
+var ErrInvalidToken = errors.New("internal/auth: invalid or expired token")
+
+// Signs a short-lived JWT identifying userID. Besides the subject
+// the token carries only its issuer, issued-at and expiry claims:
+// authorization state lives in the database, not the token itself
+func MakeJWT(userID uuid.UUID, tokenSecret string, expiresIn time.Duration) (string, error) {
+	now := time.Now().UTC()
+	claims := jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(expiresIn)),
+		Subject:   userID.String(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(tokenSecret))
+}
+
+// Verifies signature, issuer and expiry, then returns the
+// user UUID carried in the subject claim
+func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
+	claims := jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(t *jwt.Token) (any, error) {
+		// Refuse to verify against any algorithm but the one we sign
+		// with; otherwise a token crafted with, say, "alg": "none"
+		// could be steered onto a check this keyfunc can't protect
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("internal/auth: unexpected signing method %v", t.Header["alg"])
+		}
+		return []byte(tokenSecret), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return uuid.Nil, ErrInvalidToken
+	}
+	issuer, err := claims.GetIssuer()
+	if err != nil || issuer != tokenIssuer {
+		return uuid.Nil, ErrInvalidToken
+	}
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return uuid.Nil, ErrInvalidToken
+	}
+	return userID, nil
+}
+
+// Pulls the bearer token out of an Authorization header,
+// e.g. "Authorization: Bearer <token>"
+func GetBearerToken(headers http.Header) (string, error) {
+	authHeader := headers.Get("Authorization")
+	if authHeader == "" {
+		return "", errors.New("internal/auth: no Authorization header present")
+	}
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	if tokenString == authHeader {
+		return "", errors.New("internal/auth: malformed Authorization header")
+	}
+	return strings.TrimSpace(tokenString), nil
+}
+
+// Opaque, single-use refresh token. 32 random bytes hex-encoded,
+// matching the entropy already used for DummyPassword above
+func MakeRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("internal/auth: failed to generate refresh token: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Refresh tokens are stored as a SHA-256 hash so the raw,
+// bearer-usable value never touches the database
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Unexported type so context keys set by this package can
+// never collide with keys set elsewhere
+type contextKey string
+
+const userIDContextKey contextKey = "userID"
+
+// Stashes the authenticated user's UUID on the context so
+// downstream handlers never need to re-parse the JWT
+func ContextWithUserID(ctx context.Context, userID uuid.UUID) context.Context {
+	return context.WithValue(ctx, userIDContextKey, userID)
+}
+
+func UserIDFromContext(ctx context.Context) (uuid.UUID, bool) {
+	userID, ok := ctx.Value(userIDContextKey).(uuid.UUID)
+	return userID, ok
 }
\ No newline at end of file
@@ -0,0 +1,15 @@
+package mail
+
+import (
+	"log"
+	"os"
+)
+
+// Logs verification tokens to stdout instead of sending mail,
+// so local development never needs a real SMTP server
+type DevMailer struct{}
+
+func (DevMailer) SendVerificationEmail(to, token string) error {
+	log.New(os.Stdout, "", log.LstdFlags).Printf("[dev mailer] verification token for %s: %s\n", to, token)
+	return nil
+}
@@ -0,0 +1,8 @@
+package mail
+
+// Mailer sends transactional email on behalf of the server.
+// Implementations should treat a send failure as recoverable:
+// callers log it rather than fail the request that triggered it.
+type Mailer interface {
+	SendVerificationEmail(to, token string) error
+}
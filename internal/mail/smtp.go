@@ -0,0 +1,37 @@
+package mail
+
+import (
+	"fmt"
+	"net/smtp"
+)
+
+// Sends mail through a standard SMTP relay. Intended for use
+// whenever PLATFORM isn't the local dev platform
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	From     string
+	Username string
+	Password string
+}
+
+func NewSMTPMailer(host, port, from, username, password string) *SMTPMailer {
+	return &SMTPMailer{
+		Host:     host,
+		Port:     port,
+		From:     from,
+		Username: username,
+		Password: password,
+	}
+}
+
+func (m *SMTPMailer) SendVerificationEmail(to, token string) error {
+	auth := smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	msg := fmt.Sprintf(
+		"Subject: Verify your Chirpy account\r\n\r\n"+
+			"Use this token to verify your account: %s\r\n",
+		token,
+	)
+	addr := fmt.Sprintf("%s:%s", m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{to}, []byte(msg))
+}
@@ -6,9 +6,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync/atomic"
 
+	"github.com/clayzim/http-servers/internal/auth"
 	"github.com/clayzim/http-servers/internal/database"
+	"github.com/clayzim/http-servers/internal/mail"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
@@ -20,8 +23,21 @@ type serverState struct {
 	fileserverHits atomic.Int32
 	db *database.Queries
 	platform string
+	// Signing secret for access-token JWTs, from TOKEN_SECRET
+	tokenSecret string
+	// Largest page size GET /api/chirps will honor, from CHIRP_PAGE_MAX_LIMIT
+	maxChirpPageLimit int
+	mailer mail.Mailer
+	// First account to sign up with this email is auto-promoted to
+	// admin, from ADMIN_BOOTSTRAP_EMAIL. See createUser: there is
+	// otherwise no way to mint the first admin, since PromoteUser
+	// itself requires an existing admin
+	adminBootstrapEmail string
 }
 
+// Used when CHIRP_PAGE_MAX_LIMIT is unset or invalid
+const defaultMaxChirpPageLimit = 100
+
 // Increment metrics then run typical handler
 // Wraps a handler in a handler with added logic
 func (state *serverState) mwMetricsInc(next http.Handler) http.Handler {
@@ -32,16 +48,86 @@ func (state *serverState) mwMetricsInc(next http.Handler) http.Handler {
 	})
 }
 
+// Requires a valid access-token JWT in the Authorization header,
+// injecting the authenticated user's UUID into the request context
+func (state *serverState) mwRequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondWithMisdirectedError(w, http.StatusUnauthorized, "Malformed or missing access token")
+			return
+		}
+		userID, err := auth.ValidateJWT(token, state.tokenSecret)
+		if err != nil {
+			respondWithMisdirectedError(w, http.StatusUnauthorized, "Invalid or expired access token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(auth.ContextWithUserID(r.Context(), userID)))
+	})
+}
+
+// Requires the authenticated user (set by mwRequireAuth, which
+// must run first) to hold the admin role
+func (state *serverState) mwRequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := auth.UserIDFromContext(r.Context())
+		if !ok {
+			respondWithError(w, http.StatusUnauthorized, "Missing authenticated user")
+			return
+		}
+		dbUser, err := state.db.GetUserByID(r.Context(), userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "Failed to look up user")
+			return
+		}
+		if dbUser.Role != RoleAdmin {
+			respondWithError(w, http.StatusForbidden, "Admin role required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
 	// Establish database connection
 	// Load contents of .env file into environment variables
 	godotenv.Load()
 	platform := os.Getenv("PLATFORM")
 	dbURL := os.Getenv("DB_URL")
+	tokenSecret := os.Getenv("TOKEN_SECRET")
+	if tokenSecret == "" {
+		// An empty secret signs and verifies HS256 tokens with an
+		// empty key, which anyone can reproduce: that's a forgeable
+		// access token, not a missing one, so refuse to boot
+		log.Fatal("TOKEN_SECRET must be set")
+	}
+	maxChirpPageLimit := defaultMaxChirpPageLimit
+	if v, err := strconv.Atoi(os.Getenv("CHIRP_PAGE_MAX_LIMIT")); err == nil && v > 0 {
+		maxChirpPageLimit = v
+	}
 	db, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		log.Fatalf("failed to connect to database: %s\n", err)
 	}
+	// Cost parameters must be set before any hash is created,
+	// including the dummy hash below
+	auth.SetParams(auth.ParamsFromEnv())
+	// Dummy hash must be ready before any login request is served
+	auth.Initialize()
+
+	// Dev builds log verification tokens instead of sending real mail
+	var mailer mail.Mailer
+	if platform == devPlatform {
+		mailer = mail.DevMailer{}
+	} else {
+		mailer = mail.NewSMTPMailer(
+			os.Getenv("SMTP_HOST"),
+			os.Getenv("SMTP_PORT"),
+			os.Getenv("SMTP_FROM"),
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+		)
+	}
 
 	mux := http.NewServeMux()
 	server := http.Server{Handler: mux, Addr: ":8080"}
@@ -49,6 +135,10 @@ func main() {
 		// Supply database connection for handler use
 		db: database.New(db),
 		platform: platform,
+		tokenSecret: tokenSecret,
+		maxChirpPageLimit: maxChirpPageLimit,
+		mailer: mailer,
+		adminBootstrapEmail: os.Getenv("ADMIN_BOOTSTRAP_EMAIL"),
 	}
 
 	// StripPrefix means any path not prefixed "/app/" responds status 404 Not Found
@@ -57,11 +147,24 @@ func main() {
 	// Readiness endpoint path based on Kubernetes pattern
 	mux.HandleFunc("GET /api/healthz", readiness)
 	mux.HandleFunc("GET /admin/metrics", srvState.metrics)
+	// Not gated behind mwRequireAdmin: reset() already refuses to run
+	// outside the dev platform, and gating it further would leave the
+	// dev harness with no way to call it before any admin exists
 	mux.HandleFunc("POST /admin/reset", srvState.reset)
-	mux.HandleFunc("POST /api/chirps", srvState.createChirp)
+	mux.Handle("POST /admin/users/promote", srvState.mwRequireAuth(srvState.mwRequireAdmin(http.HandlerFunc(srvState.promoteUser))))
+	mux.Handle("POST /api/chirps", srvState.mwRequireAuth(http.HandlerFunc(srvState.createChirp)))
 	mux.HandleFunc("GET /api/chirps", srvState.getAllChirps)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", srvState.getChirp)
+	mux.Handle("DELETE /api/chirps/{chirpID}", srvState.mwRequireAuth(http.HandlerFunc(srvState.deleteChirp)))
+	mux.Handle("POST /api/chirps/{chirpID}/comments", srvState.mwRequireAuth(http.HandlerFunc(srvState.createComment)))
+	mux.HandleFunc("GET /api/chirps/{chirpID}/comments", srvState.getCommentsForChirp)
+	mux.HandleFunc("GET /api/comments/{commentID}", srvState.getComment)
+	mux.Handle("DELETE /api/comments/{commentID}", srvState.mwRequireAuth(http.HandlerFunc(srvState.deleteComment)))
 	mux.HandleFunc("POST /api/users", srvState.createUser)
+	mux.HandleFunc("POST /api/login", srvState.login)
+	mux.HandleFunc("POST /api/verify", srvState.verify)
+	mux.HandleFunc("POST /api/refresh", srvState.refresh)
+	mux.HandleFunc("POST /api/revoke", srvState.revoke)
 
 	err = server.ListenAndServe()
 	if err != nil {
@@ -15,11 +15,21 @@ type Chirp struct {
 	UserID    uuid.UUID `json:"user_id"`
 }
 
+// Roles recognized for the users.role column
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type ResponseUser struct {
 	ID uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 	Email string `json:"email"`
+	Role string `json:"role"`
+	// Populated on login only; omitted everywhere else
+	Token string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 	// These models are for serializing output to JSON
 	// so they should never include password hashes
 }
@@ -30,5 +40,41 @@ func ResponseFrom(dbUser database.User) ResponseUser {
 		CreatedAt: dbUser.CreatedAt,
 		UpdatedAt: dbUser.UpdatedAt,
 		Email: dbUser.Email,
+		Role: dbUser.Role,
+	}
+}
+
+// Response body for POST /api/refresh: a fresh access token
+// paired with its rotated refresh token
+type tokenPairResponse struct {
+	Token string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type Comment struct {
+	ID uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Body string `json:"body"`
+	ChirpID uuid.UUID `json:"chirp_id"`
+	UserID uuid.UUID `json:"user_id"`
+	// Populated for replies; nil for top-level comments. Clients
+	// reconstruct the reply tree from this pointer
+	ParentCommentID *uuid.UUID `json:"parent_comment_id,omitempty"`
+}
+
+func CommentFrom(dbComment database.Comment) Comment {
+	c := Comment{
+		ID: dbComment.ID,
+		CreatedAt: dbComment.CreatedAt,
+		UpdatedAt: dbComment.UpdatedAt,
+		Body: dbComment.Body,
+		ChirpID: dbComment.ChirpID,
+		UserID: dbComment.UserID,
+	}
+	if dbComment.ParentCommentID.Valid {
+		parentID := dbComment.ParentCommentID.UUID
+		c.ParentCommentID = &parentID
 	}
+	return c
 }
\ No newline at end of file
@@ -3,9 +3,13 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"math/rand"
 	"net/http"
 	"slices"
 	"strings"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // Union type of valid JSON parameters
@@ -41,6 +45,21 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 	respondWithJSON(w, code, errResponse{Error: msg})
 }
 
+// Adds a short, jittered delay before an auth failure response.
+// A fixed-time failure is itself an oracle (it tells an attacker
+// "this is the auth-failure path"); jitter keeps an observer from
+// using response timing to tell invalid, expired and revoked
+// tokens apart
+func respondWithMisdirectedError(w http.ResponseWriter, code int, msg string) {
+	time.Sleep(time.Duration(50+rand.Intn(100)) * time.Millisecond)
+	respondWithError(w, code, msg)
+}
+
+// Validates and parses a path value as a UUID in one step
+func parsePathUUID(r *http.Request, name string) (uuid.UUID, error) {
+	return uuid.Parse(r.PathValue(name))
+}
+
 // TODO: Increase sensitivity so punctuation can't cause a false negative
 func censorProfanity(in string) (cleaned string) {
 	const censor string = "****"